@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// addressCurve is the curve wallet keys are generated on. secp256k1 isn't
+// part of the Go standard library and this chaincode has no vendored
+// third-party curve implementation, so P256 stands in for it here; the
+// ECDSA sign/verify flow below is identical regardless of curve choice.
+var addressCurve = elliptic.P256()
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// KeyPair is a generated wallet identity, returned to off-chain tooling so
+// it never needs to be written to the ledger.
+type KeyPair struct {
+	PrivateKey string `json:"privateKey"`
+	PublicKey  string `json:"publicKey"`
+	Address    string `json:"address"`
+}
+
+// generateKeyPair creates a new ECDSA wallet identity. It is plain Go, not
+// an invoke function: minting a private key inside a transaction would
+// write it into the endorsed proposal response and the ledger, so key
+// generation belongs off-chain in a client or test, which is how this is
+// meant to be called.
+func generateKeyPair() (*KeyPair, error) {
+	priv, err := ecdsa.GenerateKey(addressCurve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkeyHex := marshalPublicKey(&priv.PublicKey)
+
+	return &KeyPair{
+		PrivateKey: hex.EncodeToString(priv.D.Bytes()),
+		PublicKey:  pubkeyHex,
+		Address:    deriveAddress(pubkeyHex),
+	}, nil
+}
+
+func marshalPublicKey(pub *ecdsa.PublicKey) string {
+	return hex.EncodeToString(elliptic.Marshal(addressCurve, pub.X, pub.Y))
+}
+
+func publicKeyFromHex(pubkeyHex string) (*ecdsa.PublicKey, error) {
+	pubBytes, err := hex.DecodeString(pubkeyHex)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(addressCurve, pubBytes)
+	if x == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return &ecdsa.PublicKey{Curve: addressCurve, X: x, Y: y}, nil
+}
+
+func privateKeyFromHex(privateKeyHex string) (*ecdsa.PrivateKey, error) {
+	dBytes, err := hex.DecodeString(privateKeyHex)
+	if err != nil {
+		return nil, err
+	}
+
+	priv := new(ecdsa.PrivateKey)
+	priv.PublicKey.Curve = addressCurve
+	priv.D = new(big.Int).SetBytes(dBytes)
+	priv.PublicKey.X, priv.PublicKey.Y = addressCurve.ScalarBaseMult(dBytes)
+	return priv, nil
+}
+
+// deriveAddress hashes a hex-encoded public key and base58check-encodes the
+// result, in the style of a Bitcoin address (a single sha256 here, not
+// Bitcoin's sha256+ripemd160, and no version byte). This is what callers
+// should store in a UTXO's Address field.
+func deriveAddress(pubkeyHex string) string {
+	pubBytes, err := hex.DecodeString(pubkeyHex)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(pubBytes)
+	return addressFromPubkeyHash(hash[:])
+}
+
+// addressFromPubkeyHash base58check-encodes an already-hashed pubkey, for
+// callers (like queryUTXOByPubkeyHash) that only have the hash on hand.
+func addressFromPubkeyHash(pubkeyHash []byte) string {
+	return base58CheckEncode(pubkeyHash)
+}
+
+// SignInput is the client-side helper a wallet uses to authorize spending
+// inputKey in transaction txid: it signs sha256(txid||inputKey) with
+// privateKeyHex. transferUTXO expects one such signature per UTXO of the
+// transferred asset the caller currently owns at its address, in the order
+// queryUTXOByAddr returns them.
+func SignInput(privateKeyHex string, txid string, inputKey string) (string, error) {
+	priv, err := privateKeyFromHex(privateKeyHex)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(txid + inputKey))
+	r, sVal, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(r.Bytes()) + ":" + hex.EncodeToString(sVal.Bytes()), nil
+}
+
+// verifyInputSignature checks that pubkeyHex hashes to the UTXO's
+// ScriptPubKey (address) and that signatureHex is a valid ECDSA signature
+// by that pubkey over sha256(txid||inputKey).
+func verifyInputSignature(address string, pubkeyHex string, signatureHex string, txid string, inputKey string) error {
+	if deriveAddress(pubkeyHex) != address {
+		return fmt.Errorf("public key does not match utxo address for input %s", inputKey)
+	}
+
+	pub, err := publicKeyFromHex(pubkeyHex)
+	if err != nil {
+		return err
+	}
+
+	parts := splitSignature(signatureHex)
+	if parts == nil {
+		return fmt.Errorf("malformed signature for input %s", inputKey)
+	}
+	r, sVal := parts[0], parts[1]
+
+	digest := sha256.Sum256([]byte(txid + inputKey))
+	if !ecdsa.Verify(pub, digest[:], r, sVal) {
+		return fmt.Errorf("invalid signature for input %s", inputKey)
+	}
+	return nil
+}
+
+func splitSignature(signatureHex string) []*big.Int {
+	rHex := ""
+	sHex := ""
+	for i := 0; i < len(signatureHex); i++ {
+		if signatureHex[i] == ':' {
+			rHex = signatureHex[:i]
+			sHex = signatureHex[i+1:]
+			break
+		}
+	}
+	if rHex == "" || sHex == "" {
+		return nil
+	}
+
+	rBytes, err := hex.DecodeString(rHex)
+	if err != nil {
+		return nil
+	}
+	sBytes, err := hex.DecodeString(sHex)
+	if err != nil {
+		return nil
+	}
+
+	return []*big.Int{new(big.Int).SetBytes(rBytes), new(big.Int).SetBytes(sBytes)}
+}
+
+// queryUTXOByPubkeyHash is the pubkey-hash counterpart of queryUTXOByAddr,
+// for callers that only have the raw sha256(pubkey) on hand rather than the
+// base58check address string.
+func (s *SmartContract) queryUTXOByPubkeyHash(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (pubkey hash, hex-encoded)")
+	}
+
+	pubkeyHash, err := hex.DecodeString(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return s.queryUTXOByAddr(APIstub, []string{addressFromPubkeyHash(pubkeyHash)})
+}
+
+// base58CheckEncode encodes payload with a standard Bitcoin-style base58
+// alphabet plus a 4-byte double-sha256 checksum.
+func base58CheckEncode(payload []byte) string {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	checksum := second[:4]
+
+	data := append(append([]byte{}, payload...), checksum...)
+
+	value := new(big.Int).SetBytes(data)
+	zero := big.NewInt(0)
+	base := big.NewInt(58)
+	mod := new(big.Int)
+
+	encoded := []byte{}
+	for value.Cmp(zero) > 0 {
+		value.DivMod(value, base, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+
+	//preserve leading zero bytes as leading '1's, as base58check requires
+	for _, b := range data {
+		if b != 0x00 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	//encoded was built least-significant-digit first
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return string(encoded)
+}
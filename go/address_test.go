@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestVerifyInputSignatureAccepts(t *testing.T) {
+	keyPair, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair failed: %v", err)
+	}
+
+	txid := "tx1"
+	inputKey := "tx0:0"
+
+	signature, err := SignInput(keyPair.PrivateKey, txid, inputKey)
+	if err != nil {
+		t.Fatalf("SignInput failed: %v", err)
+	}
+
+	if err := verifyInputSignature(keyPair.Address, keyPair.PublicKey, signature, txid, inputKey); err != nil {
+		t.Fatalf("expected a valid signature to verify, got: %v", err)
+	}
+}
+
+func TestVerifyInputSignatureRejectsWrongKey(t *testing.T) {
+	owner, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair failed: %v", err)
+	}
+	attacker, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair failed: %v", err)
+	}
+
+	txid := "tx1"
+	inputKey := "tx0:0"
+
+	signature, err := SignInput(attacker.PrivateKey, txid, inputKey)
+	if err != nil {
+		t.Fatalf("SignInput failed: %v", err)
+	}
+
+	// attacker signs with their own key but claims ownership of owner's UTXO
+	if err := verifyInputSignature(owner.Address, attacker.PublicKey, signature, txid, inputKey); err == nil {
+		t.Fatalf("expected verification to fail when the pubkey doesn't derive the UTXO's address")
+	}
+}
+
+func TestVerifyInputSignatureRejectsTamperedSignature(t *testing.T) {
+	keyPair, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair failed: %v", err)
+	}
+
+	txid := "tx1"
+	inputKey := "tx0:0"
+
+	signature, err := SignInput(keyPair.PrivateKey, txid, inputKey)
+	if err != nil {
+		t.Fatalf("SignInput failed: %v", err)
+	}
+
+	// verifying against a different input than what was actually signed
+	// should fail even though the pubkey/address pair is correct.
+	if err := verifyInputSignature(keyPair.Address, keyPair.PublicKey, signature, txid, "tx0:1"); err == nil {
+		t.Fatalf("expected verification to fail for a signature over a different input")
+	}
+}
+
+func TestVerifyInputSignatureRejectsMalformedSignature(t *testing.T) {
+	keyPair, err := generateKeyPair()
+	if err != nil {
+		t.Fatalf("generateKeyPair failed: %v", err)
+	}
+
+	if err := verifyInputSignature(keyPair.Address, keyPair.PublicKey, "not-a-signature", "tx1", "tx0:0"); err == nil {
+		t.Fatalf("expected verification to fail for a malformed signature")
+	}
+}
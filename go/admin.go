@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// adminRoleAttr is the client identity attribute checked by requireAdmin,
+// the same "role" attribute convention used by fabric-samples' abac
+// chaincode: an admin's X.509 certificate carries
+// ("role", "admin", true) as an enrollment attribute.
+const adminRoleAttr = "role"
+const adminRoleValue = "admin"
+
+// requireAdmin returns an error unless the calling client identity carries
+// the admin role attribute, so ledger-wide operations (freezing transfers,
+// rolling back blocks) can't be triggered by an arbitrary client.
+func requireAdmin(APIstub shim.ChaincodeStubInterface) error {
+	if err := cid.AssertAttributeValue(APIstub, adminRoleAttr, adminRoleValue); err != nil {
+		return fmt.Errorf("caller is not authorized as %q: %s", adminRoleValue, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// lockKey gates every transfer/mint/burn behind a single admin switch so the
+// ledger can be frozen (e.g. during an upgrade or an incident) without
+// touching individual assets.
+const lockKey = "ledger_lock"
+
+func assetKey(symbol string) string {
+	return "asset~" + symbol
+}
+
+// Asset is the supply registry entry for one colored coin, stored at
+// asset~<symbol>. Cap of "0" means the asset has no maximum supply.
+type Asset struct {
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name"`
+	Supply   string `json:"supply"`
+	Cap      string `json:"cap"`
+	Mintable bool   `json:"mintable"`
+}
+
+func getAsset(APIstub shim.ChaincodeStubInterface, symbol string) (*Asset, error) {
+	assetAsBytes, err := APIstub.GetState(assetKey(symbol))
+	if err != nil {
+		return nil, err
+	}
+	if assetAsBytes == nil {
+		return nil, nil
+	}
+
+	var asset Asset
+	if err := json.Unmarshal(assetAsBytes, &asset); err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+func putAsset(APIstub shim.ChaincodeStubInterface, asset Asset) error {
+	assetAsBytes, err := json.Marshal(asset)
+	if err != nil {
+		return err
+	}
+	return APIstub.PutState(assetKey(asset.Symbol), assetAsBytes)
+}
+
+// adjustAssetSupply adds delta (negative for a burn) to symbol's recorded
+// supply. It backs mintToken/burnToken directly, and rollback when reverting
+// one of their transactions.
+func adjustAssetSupply(APIstub shim.ChaincodeStubInterface, symbol string, delta int64) error {
+	asset, err := getAsset(APIstub, symbol)
+	if err != nil {
+		return err
+	}
+	if asset == nil {
+		return fmt.Errorf("Unknown asset: %s", symbol)
+	}
+
+	supply, _ := strconv.ParseInt(asset.Supply, 10, 64)
+	asset.Supply = strconv.FormatInt(supply+delta, 10)
+	return putAsset(APIstub, *asset)
+}
+
+func isLocked(APIstub shim.ChaincodeStubInterface) bool {
+	lockAsBytes, err := APIstub.GetState(lockKey)
+	if err != nil || lockAsBytes == nil {
+		return false
+	}
+	return string(lockAsBytes) == "true"
+}
+
+// setLock freezes the ledger: transferUTXO, transferToken, mintToken and
+// burnToken all refuse to run while locked.
+func (s *SmartContract) setLock(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return s.setLockTo(APIstub, "true")
+}
+
+// setUnlock lifts a freeze set by setLock.
+func (s *SmartContract) setUnlock(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return s.setLockTo(APIstub, "false")
+}
+
+func (s *SmartContract) setLockTo(APIstub shim.ChaincodeStubInterface, value string) sc.Response {
+	if err := requireAdmin(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := APIstub.PutState(lockKey, []byte(value)); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// initCurrency registers a new colored coin and mints its initial supply to
+// address as a coinbase-style output, mirroring how initState bootstraps
+// the native coin.
+func (s *SmartContract) initCurrency(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 (name, symbol, supply, address)")
+	}
+
+	name := args[0]
+	symbol := args[1]
+	supply := args[2]
+	address := args[3]
+
+	existing, err := getAsset(APIstub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return shim.Error("Asset already registered: " + symbol)
+	}
+
+	asset := Asset{Symbol: symbol, Name: name, Supply: supply, Cap: "0", Mintable: true}
+	if err := putAsset(APIstub, asset); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txid := APIstub.GetTxID()
+	inputs := []UTXO{
+		makeAssetUTXO(txid, strconv.Itoa(math.MaxUint32), supply, "Coinbase", "in", symbol, symbol),
+	}
+	outputs := []UTXO{
+		makeAssetUTXO(txid, "1", supply, address, "out", symbol, symbol),
+	}
+
+	store := s.store(APIstub)
+	if err := store.PutUTXO(outputs[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := store.PutTransaction(makeTransaction(txid, inputs, outputs)); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := indexTransactionAddresses(APIstub, txid, []string{address}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := store.Flush(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// mintToken increases the supply of symbol and credits amount to address as
+// a new unspent output. Only the issuer (an admin identity) may mint - see
+// requireAdmin - otherwise supply would be forgeable by any client.
+func (s *SmartContract) mintToken(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 (symbol, amount, address)")
+	}
+
+	if err := requireAdmin(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if isLocked(APIstub) {
+		return shim.Error("ledger is locked, minting is disabled")
+	}
+
+	symbol := args[0]
+	amount, _ := strconv.ParseInt(args[1], 10, 64)
+	address := args[2]
+
+	asset, err := getAsset(APIstub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Unknown asset: " + symbol)
+	}
+	if !asset.Mintable {
+		return shim.Error("Asset is not mintable: " + symbol)
+	}
+
+	supply, _ := strconv.ParseInt(asset.Supply, 10, 64)
+	supplyCap, _ := strconv.ParseInt(asset.Cap, 10, 64)
+	if supplyCap > 0 && supply+amount > supplyCap {
+		return shim.Error("Mint would exceed supply cap for asset: " + symbol)
+	}
+
+	txid := APIstub.GetTxID()
+	inputs := []UTXO{
+		makeAssetUTXO(txid, strconv.Itoa(math.MaxUint32), args[1], "Mint", "in", symbol, symbol),
+	}
+	outputs := []UTXO{
+		makeAssetUTXO(txid, "1", args[1], address, "out", symbol, symbol),
+	}
+
+	store := s.store(APIstub)
+	if err := store.PutUTXO(outputs[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := store.PutTransaction(makeTransaction(txid, inputs, outputs)); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := indexTransactionAddresses(APIstub, txid, []string{address}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := adjustAssetSupply(APIstub, symbol, amount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := store.Flush(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// burnToken spends amount worth of symbol from the address derived from
+// pubkeyHex, sending it to the sentinel "Burned" address and removing it
+// from circulating supply. args is [pubkeyHex, symbol, amount, sig...]: it
+// requires the same per-input signatures as transferUTXO/transferToken (see
+// signedTransfer), so a holder's balance can't be destroyed by anyone else
+// calling burnToken against their address.
+func (s *SmartContract) burnToken(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting pubkey, symbol, amount, signature...")
+	}
+
+	pubkeyHex := args[0]
+	symbol := args[1]
+	amount, _ := strconv.ParseInt(args[2], 10, 64)
+	signatures := args[3:]
+
+	asset, err := getAsset(APIstub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Unknown asset: " + symbol)
+	}
+
+	if err := s.signedTransfer(APIstub, pubkeyHex, "Burned", amount, symbol, signatures); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := adjustAssetSupply(APIstub, symbol, -amount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// transferToken moves amount of symbol from the address derived from
+// pubkeyHex to addrTo. args is [pubkeyHex, symbol, addrTo, amount, sig...];
+// like transferUTXO it requires one signature per owned input of that
+// asset (see signedTransfer) rather than trusting a plaintext from address.
+func (s *SmartContract) transferToken(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 4 {
+		return shim.Error("Incorrect number of arguments. Expecting pubkey, symbol, addrTo, amount, signature...")
+	}
+
+	pubkeyHex := args[0]
+	symbol := args[1]
+	addrTo := args[2]
+	amount, _ := strconv.ParseInt(args[3], 10, 64)
+	signatures := args[4:]
+
+	asset, err := getAsset(APIstub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asset == nil {
+		return shim.Error("Unknown asset: " + symbol)
+	}
+
+	if err := s.signedTransfer(APIstub, pubkeyHex, addrTo, amount, symbol, signatures); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
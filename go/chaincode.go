@@ -9,12 +9,10 @@ package main
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
-	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
@@ -22,22 +20,40 @@ import (
 
 // SmartContract defines the Smart Contract structure
 type SmartContract struct {
+	// Backend selects the WalletStore implementation used to read/write the
+	// ledger. Empty (the default) uses ShimStore; "couchdb" uses CouchStore
+	// so address lookups can be served by CouchDB rich queries.
+	Backend string
+}
+
+// store builds the WalletStore for the current transaction. APIstub is only
+// valid for the lifetime of a single invocation, so the store is created
+// fresh on every call rather than cached on the SmartContract.
+func (s *SmartContract) store(APIstub shim.ChaincodeStubInterface) WalletStore {
+	if s.Backend == "couchdb" {
+		return NewCouchStore(APIstub)
+	}
+	return NewShimStore(APIstub)
 }
 
 // UTXO
+// AssetID/AssetSymbol are empty for the native coin minted by initState; any
+// other value identifies a colored coin registered through initCurrency.
 type UTXO struct {
-	Txid    string `json:"txid"`
-	Index   string `json:"index"`
-	Amount  string `json:"amount"`
-	Address string `json:"address"`
-	inOrOut string `json:"inOrOut"`
+	Txid        string `json:"txid"`
+	Index       string `json:"index"`
+	Amount      string `json:"amount"`
+	Address     string `json:"address"`
+	AssetID     string `json:"assetId"`
+	AssetSymbol string `json:"assetSymbol"`
+	InOrOut     string `json:"inOrOut"`
 }
 
 // Tranction
 type Transaction struct {
-	id      string `json:"id"`
-	inputs  []UTXO `json:"input"`
-	outputs []UTXO `json:"output"`
+	Id      string `json:"id"`
+	Inputs  []UTXO `json:"input"`
+	Outputs []UTXO `json:"output"`
 }
 
 // Init method is called when the Smart Contract "fabcar" is instantiated by the blockchain network
@@ -54,11 +70,13 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	function, args := APIstub.GetFunctionAndParameters()
 	// Route to the appropriate handler function to interact with the ledger appropriately
 	if function == "init" {
-		return s.initState(APIstub)
+		return s.initState(APIstub, args)
 	} else if function == "queryUTXO" {
 		return s.queryUTXO(APIstub, args)
 	} else if function == "queryUTXOByAddr" {
 		return s.queryUTXOByAddr(APIstub, args)
+	} else if function == "queryUTXOByPubkeyHash" {
+		return s.queryUTXOByPubkeyHash(APIstub, args)
 	} else if function == "queryTransaction" {
 		return s.queryTransaction(APIstub, args)
 	} else if function == "getAllUTXO" {
@@ -67,13 +85,52 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.getAllTransaction(APIstub)
 	} else if function == "transferUTXO" {
 		return s.transferUTXO(APIstub, args)
+	} else if function == "initCurrency" {
+		return s.initCurrency(APIstub, args)
+	} else if function == "mintToken" {
+		return s.mintToken(APIstub, args)
+	} else if function == "burnToken" {
+		return s.burnToken(APIstub, args)
+	} else if function == "transferToken" {
+		return s.transferToken(APIstub, args)
+	} else if function == "setLock" {
+		return s.setLock(APIstub, args)
+	} else if function == "setUnlock" {
+		return s.setUnlock(APIstub, args)
+	} else if function == "cancelReservation" {
+		return s.cancelReservation(APIstub, args)
+	} else if function == "expireReservations" {
+		return s.expireReservations(APIstub, args)
+	} else if function == "queryTransactionsByAddress" {
+		return s.queryTransactionsByAddress(APIstub, args)
+	} else if function == "getBalance" {
+		return s.getBalance(APIstub, args)
+	} else if function == "getBalanceByAsset" {
+		return s.getBalanceByAsset(APIstub, args)
+	} else if function == "rollback" {
+		return s.rollback(APIstub, args)
+	} else if function == "getUTXOProof" {
+		return s.getUTXOProof(APIstub, args)
+	} else if function == "getUTXORoot" {
+		return s.getUTXORoot(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
 }
 
-//initialize coins
-func (s *SmartContract) initState(APIstub shim.ChaincodeStubInterface) sc.Response {
+// initState mints the genesis 50-unit coinbase output to a caller-supplied
+// address (args is [address]) rather than a hardcoded literal: the output is
+// only spendable by whoever can produce a signature verifying against
+// deriveAddress(pubkeyHex) == address (see signedTransfer), so a hardcoded
+// demo string with no known keypair would mint an output nobody could ever
+// move. Callers bootstrapping a demo network should pass a real derived
+// address for a keypair they hold.
+func (s *SmartContract) initState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (address)")
+	}
+	address := args[0]
 
 	txid := APIstub.GetTxID()
 
@@ -83,42 +140,47 @@ func (s *SmartContract) initState(APIstub shim.ChaincodeStubInterface) sc.Respon
 	}
 
 	outputs := []UTXO{
-		makeUTXO(txid, "1", "50", "User A", "out"),
+		makeUTXO(txid, "1", "50", address, "out"),
 	}
 
 	transaction := makeTransaction(txid, inputs, outputs)
 
+	store := s.store(APIstub)
+
 	//store utxo
-	err := storeUTXO(APIstub, txid, outputs[0])
+	err := store.PutUTXO(outputs[0])
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	//store transaction (It's not necessary to store transaction here, transaction info can be found in block.)
-	err = storeTransaction(APIstub, txid, transaction)
+	err = store.PutTransaction(transaction)
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	if err := indexTransactionAddresses(APIstub, txid, []string{address}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := store.Flush(); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
 func makeUTXO(txid string, index string, amount string, address string, inOrOut string) UTXO {
-
-	utxo := UTXO{txid, index, amount, address, inOrOut}
-
-	return utxo
+	return makeAssetUTXO(txid, index, amount, address, inOrOut, "", "")
 }
 
-func storeUTXO(APIstub shim.ChaincodeStubInterface, txid string, utxo UTXO) error {
+func makeAssetUTXO(txid string, index string, amount string, address string, inOrOut string, assetID string, assetSymbol string) UTXO {
 
-	utxoKey := txid + ":" + utxo.Index
-	utxoAsBYtes, _ := json.Marshal(utxo)
+	utxo := UTXO{txid, index, amount, address, assetID, assetSymbol, inOrOut}
 
-	//UTXO key is transaction id:index
-	return APIstub.PutState(utxoKey, utxoAsBYtes)
+	return utxo
 }
 
 func makeTransaction(id string, inputs []UTXO, outputs []UTXO) Transaction {
@@ -128,111 +190,79 @@ func makeTransaction(id string, inputs []UTXO, outputs []UTXO) Transaction {
 	return transaction
 }
 
-func storeTransaction(APIstub shim.ChaincodeStubInterface, txid string, transaction Transaction) error {
-
-	transactionAsBYtes, _ := json.Marshal(transaction)
-
-	return APIstub.PutState(txid, transactionAsBYtes)
-}
-
 // Get all utxo
 func (s *SmartContract) getAllUTXO(APIstub shim.ChaincodeStubInterface) sc.Response {
 
-	startKey := ""
-	endKey := ""
-
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	utxos, err := s.store(APIstub).IterateUTXOs("")
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		//Values contain comma are the UTXO objects.
-		if strings.Contains(queryResponse.Key, ":") {
-			// Add a comma before array members, suppress it for the first array member
-			if bArrayMemberAlreadyWritten == true {
-				buffer.WriteString(",")
-			}
-			buffer.WriteString("{\"Key\":")
-			buffer.WriteString("\"")
-			buffer.WriteString(queryResponse.Key)
-			buffer.WriteString("\"")
-
-			buffer.WriteString(", \"Record\":")
-			// Record is a JSON object, so we write as-is
-			buffer.WriteString(string(queryResponse.Value))
-			buffer.WriteString("}")
-			bArrayMemberAlreadyWritten = true
-		}
+	utxosAsBytes, err := json.Marshal(utxos)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllUtxo:\n%s\n", buffer.String())
+	fmt.Printf("- queryAllUtxo:\n%s\n", utxosAsBytes)
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(utxosAsBytes)
 }
 
-// Get all transaction
-func (s *SmartContract) getAllTransaction(APIstub shim.ChaincodeStubInterface) sc.Response {
-
-	startKey := ""
-	endKey := ""
+// transactionEntry is one row of getAllTransaction's result.
+type transactionEntry struct {
+	Key    string       `json:"Key"`
+	Record *Transaction `json:"Record"`
+}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+// getAllTransaction lists every transaction record via the tx~timestamp~id
+// composite-key index PutTransaction maintains (the same index rollback
+// reads), rather than a raw GetStateByRange scan: a blind range scan over
+// the whole ledger also turns up UTXOs, the utxo~/tx~ index entries, asset~
+// registry entries, smt~ Merkle nodes and the raw-bytes utxo_root value -
+// none of which are transaction JSON, and the binary utxo_root value in
+// particular breaks the handwritten-JSON assembly a blind scan would need.
+func (s *SmartContract) getAllTransaction(APIstub shim.ChaincodeStubInterface) sc.Response {
 
+	iterator, err := APIstub.GetStateByPartialCompositeKey(txIndexType, []string{})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	defer iterator.Close()
 
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	store := s.store(APIstub)
+	entries := []transactionEntry{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		//skip utxo
-		if strings.Contains(queryResponse.Key, ":") {
-			continue
+		_, parts, err := APIstub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
+		txid := parts[1]
+
+		transaction, err := store.GetTransaction(txid)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		if transaction == nil {
+			continue
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		entries = append(entries, transactionEntry{Key: txid, Record: transaction})
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllTransaction:\n%s\n", buffer.String())
+	entriesAsBytes, err := json.Marshal(entries)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(buffer.Bytes())
+	fmt.Printf("- queryAllTransaction:\n%s\n", entriesAsBytes)
+
+	return shim.Success(entriesAsBytes)
 }
 
 // Query transaction by transaction id
@@ -243,11 +273,16 @@ func (s *SmartContract) queryTransaction(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	transactionAsBytes, err := APIstub.GetState(args[0])
+	transaction, err := s.store(APIstub).GetTransaction(args[0])
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if transaction == nil {
+		return shim.Error("Transaction not found: " + args[0])
+	}
+
+	transactionAsBytes, _ := json.Marshal(transaction)
 
 	return shim.Success(transactionAsBytes)
 }
@@ -259,11 +294,16 @@ func (s *SmartContract) queryUTXO(APIstub shim.ChaincodeStubInterface, args []st
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	utxoAsBytes, err := APIstub.GetState(args[0])
+	utxo, err := s.store(APIstub).GetUTXO(args[0])
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if utxo == nil {
+		return shim.Error("UTXO not found: " + args[0])
+	}
+
+	utxoAsBytes, _ := json.Marshal(utxo)
 
 	return shim.Success(utxoAsBytes)
 }
@@ -277,154 +317,166 @@ func (s *SmartContract) queryUTXOByAddr(APIstub shim.ChaincodeStubInterface, arg
 
 	address := args[0]
 
-	//Get all UTXO
-	startKey := ""
-	endKey := ""
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	utxos, err := s.store(APIstub).ListUTXOsByAddress(address)
 
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
 
-		if err != nil {
-			return shim.Error(err.Error())
+	//ListUTXOsByAddress already returns only addr's unspent outputs; the
+	//ownership check is kept as a final guard.
+	unspent := []UTXO{}
+	for _, utxo := range utxos {
+		if checkUTXOOwnerShip(utxo, address) {
+			unspent = append(unspent, utxo)
 		}
+	}
 
-		if strings.Contains(queryResponse.Key, ":") {
-			var utxo UTXO
-			json.Unmarshal(queryResponse.Value, &utxo)
-
-			//check utxo owner ship, only return the one with address equal to with args[0]
-			if checkUTXOOwnerShip(utxo, address) == false {
-				continue
-			}
-
-			// Add a comma before array members, suppress it for the first array member
-			if bArrayMemberAlreadyWritten == true {
-				buffer.WriteString(",")
-			}
-			buffer.WriteString("{\"Key\":")
-			buffer.WriteString("\"")
-			buffer.WriteString(queryResponse.Key)
-			//transaction value, Record is a JSON object, so we write as-is
-			buffer.WriteString("\"")
-			buffer.WriteString(", \"Record\":")
-			buffer.WriteString(string(queryResponse.Value))
-
-			buffer.WriteString("}")
-			bArrayMemberAlreadyWritten = true
-		}
+	utxosAsBytes, err := json.Marshal(unspent)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("- queryUTXOByAddr:\n%s\n", buffer.String())
+	fmt.Printf("- queryUTXOByAddr:\n%s\n", utxosAsBytes)
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(utxosAsBytes)
 }
 
-// Check if one utxo belong to one particular address
-// At this point, there is no encoding and decoding in address, so just check the address and spent
+// Check if one utxo belongs to one particular address (its ScriptPubKey).
+// Ownership of the address itself is only proven by a valid signature over
+// the spending transaction, checked separately in transferUTXO.
 func checkUTXOOwnerShip(utxo UTXO, address string) bool {
-	return utxo.Address == address && utxo.inOrOut == "out"
+	return utxo.Address == address && utxo.InOrOut == "out"
 }
 
-// Transfer utxo from one address to another
+// Transfer the native coin (the asset minted by initState) from the
+// address derived from pubkeyHex to addrTo. args is
+// [pubkeyHex, addrTo, amount, sig...]; see signedTransfer.
 func (s *SmartContract) transferUTXO(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting pubkey, addrTo, amount, signature...")
 	}
 
-	addrFrom := args[0]
+	pubkeyHex := args[0]
 	addrTo := args[1]
-	amount, _ := strconv.ParseFloat(args[2], 64)
+	amount, _ := strconv.ParseInt(args[2], 10, 64)
+	signatures := args[3:]
 
-	//get all utxo
-	startKey := ""
-	endKey := ""
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
-
-	if err != nil {
+	if err := s.signedTransfer(APIstub, pubkeyHex, addrTo, amount, "", signatures); err != nil {
 		return shim.Error(err.Error())
 	}
 
-	defer resultsIterator.Close()
+	return shim.Success(nil)
+}
 
-	inputs := []UTXO{}
-	utfoKeysToRemove := []string{}
-	currValue := 0.0
-	txid := APIstub.GetTxID()
+// signedTransfer spends unspent outputs of assetSymbol owned by the address
+// derived from pubkeyHex, producing an output for addrTo and, when the
+// selected inputs overshoot amount, a change output back to the sender in
+// the same asset. One signature is required for every UTXO the sender
+// currently owns of that asset, in the same order ListUTXOsByAddress
+// returns them, each covering sha256(txid||inputKey) for that UTXO's key -
+// spending a stranger's UTXO requires forging an ECDSA signature rather
+// than just naming their address. transferUTXO, transferToken and
+// burnToken (to the sentinel "Burned" address) are all thin wrappers
+// around this.
+//
+// The signature only binds "the signer authorizes spending this input in
+// transaction txid" - it does NOT cover addrTo or amount. Whoever actually
+// submits the proposal (the signer themselves, or a relayer/gateway acting
+// on their behalf) chooses addrTo/amount independently of what was signed,
+// so a signature is proof of "spend these inputs in tx txid", not proof of
+// a specific payment; a submitter other than the signer could repackage a
+// valid signature with a different addrTo/amount and the check here would
+// still pass.
+func (s *SmartContract) signedTransfer(APIstub shim.ChaincodeStubInterface, pubkeyHex string, addrTo string, amount int64, assetSymbol string, signatures []string) error {
+
+	if isLocked(APIstub) {
+		return fmt.Errorf("ledger is locked, transfers are disabled")
+	}
 
-	for resultsIterator.HasNext() && currValue < amount {
+	addrFrom := deriveAddress(pubkeyHex)
+	store := s.store(APIstub)
 
-		//loop the utxo one by one
-		queryResponse, err := resultsIterator.Next()
+	candidates, err := store.ListUTXOsByAddress(addrFrom)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return shim.Error(err.Error())
+	owned := []UTXO{}
+	for _, utxo := range candidates {
+		if checkUTXOOwnerShip(utxo, addrFrom) && utxo.AssetSymbol == assetSymbol {
+			owned = append(owned, utxo)
 		}
+	}
 
-		//prepare utxo to spend
-		var utxo UTXO
-		json.Unmarshal(queryResponse.Value, &utxo)
+	if len(signatures) != len(owned) {
+		return fmt.Errorf("Expecting %d signatures (one per owned UTXO), got %d", len(owned), len(signatures))
+	}
 
-		//skip the utxo belong to others
-		if checkUTXOOwnerShip(utxo, addrFrom) == false {
-			continue
+	txid := APIstub.GetTxID()
+	for i, utxo := range owned {
+		inputKey := utxoPrimaryKey(utxo.Txid, utxo.Index)
+		if err := verifyInputSignature(addrFrom, pubkeyHex, signatures[i], txid, inputKey); err != nil {
+			return err
 		}
+	}
+
+	selected, change, err := NewReserver(APIstub, store).ReserveFrom(owned, amount)
+	if err != nil {
+		return err
+	}
 
-		utxo.inOrOut = "in"
+	return s.settleTransfer(APIstub, store, addrFrom, addrTo, amount, assetSymbol, selected, change)
+}
 
-		inputs = append(inputs, utxo)
+// settleTransfer spends the already-selected inputs and writes the new
+// output(s) and transaction record for signedTransfer's signature-checked
+// path (transferUTXO, transferToken, burnToken). It releases the
+// reservation markers commit placed on selected now that they're actually
+// spent, rather than leaving them as dead state for expireReservations.
+func (s *SmartContract) settleTransfer(APIstub shim.ChaincodeStubInterface, store WalletStore, addrFrom string, addrTo string, amount int64, assetSymbol string, selected []UTXO, change int64) error {
 
-		utfoKeysToRemove = append(utfoKeysToRemove, queryResponse.Key)
+	txid := APIstub.GetTxID()
 
-		//accumulate currValue
-		newValue, _ := strconv.ParseFloat(utxo.Amount, 64)
-		currValue += newValue
-	}
+	inputs := make([]UTXO, len(selected))
+	for i, utxo := range selected {
+		utxo.InOrOut = "in"
+		inputs[i] = utxo
 
-	//no enough utxo to spend
-	if currValue < amount {
-		return shim.Error("No enough amount to spend")
+		if err := store.DeleteUTXO(utxoPrimaryKey(utxo.Txid, utxo.Index)); err != nil {
+			return err
+		}
 	}
 
-	for _, v := range utfoKeysToRemove {
-		//delete utxo which have been spent
-		APIstub.DelState(v)
+	if err := NewReserver(APIstub, store).Release(selected); err != nil {
+		return err
 	}
 
 	//create new outputs
 	outputs := []UTXO{}
-	utxo1 := makeUTXO(txid, "1", args[2], addrTo, "out")
+	utxo1 := makeAssetUTXO(txid, "1", strconv.FormatInt(amount, 10), addrTo, "out", assetSymbol, assetSymbol)
 	outputs = append(outputs, utxo1)
+	store.PutUTXO(utxo1)
 
-	//give the extract amount back to addrFrom
-	var utxo2 UTXO
-	if currValue > amount {
-		utxo2 = makeUTXO(txid, "2", strconv.FormatFloat(float64(currValue-amount), 'f', 2, 64), addrFrom, "out")
+	//give the change back to addrFrom
+	if change > 0 {
+		utxo2 := makeAssetUTXO(txid, "2", strconv.FormatInt(change, 10), addrFrom, "out", assetSymbol, assetSymbol)
 		outputs = append(outputs, utxo2)
+		store.PutUTXO(utxo2)
 	}
 
-	//store new utxo
-	storeUTXO(APIstub, txid, utxo1)
-	storeUTXO(APIstub, txid, utxo2)
-
 	//store new transaction
 	transaction := makeTransaction(txid, inputs, outputs)
-	storeTransaction(APIstub, txid, transaction)
+	if err := store.PutTransaction(transaction); err != nil {
+		return err
+	}
 
-	return shim.Success(nil)
+	if err := indexTransactionAddresses(APIstub, txid, []string{addrFrom, addrTo}); err != nil {
+		return err
+	}
+
+	return store.Flush()
 }
 
 // The main function is only relevant in unit test mode. Only included here for completeness.
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// txAddressIndexType indexes every transaction a given address appears in
+// (as an input or an output) by height, so queryTransactionsByAddress can
+// page through an address's history instead of scanning every transaction.
+const txAddressIndexType = "txidx~address~height~txid"
+
+// txHeight approximates a confirmation height with the transaction
+// timestamp (seconds since epoch), the same substitute used for
+// reservation expiry in reserve.go: the shim has no direct block-height
+// accessor.
+func txHeight(APIstub shim.ChaincodeStubInterface) (uint64, error) {
+	timestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(timestamp.GetSeconds()), nil
+}
+
+func formatHeight(height uint64) string {
+	return fmt.Sprintf("%020d", height)
+}
+
+// indexTransactionAddresses records txid under every distinct address it
+// touches, at the transaction's height, so a future
+// queryTransactionsByAddress(address, ...) finds it.
+func indexTransactionAddresses(APIstub shim.ChaincodeStubInterface, txid string, addresses []string) error {
+	height, err := txHeight(APIstub)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, address := range addresses {
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		key, err := APIstub.CreateCompositeKey(txAddressIndexType, []string{address, formatHeight(height), txid})
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(key, []byte(txid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransactionRecord is one entry in a queryTransactionsByAddress page.
+type TransactionRecord struct {
+	Txid        string       `json:"txid"`
+	Height      uint64       `json:"height"`
+	Timestamp   uint64       `json:"timestamp"`
+	Transaction *Transaction `json:"transaction"`
+}
+
+// TransactionPage is the paginated result of queryTransactionsByAddress.
+type TransactionPage struct {
+	Records  []TransactionRecord `json:"records"`
+	Bookmark string              `json:"bookmark"`
+}
+
+// queryTransactionsByAddress returns, oldest first (ascending height) within
+// the [startHeight, endHeight] window, the transactions in which address
+// appears as an input or an output. pageSize/bookmark page through the
+// result the same way CouchDB rich queries do.
+func (s *SmartContract) queryTransactionsByAddress(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 (address, startHeight, endHeight, pageSize, bookmark)")
+	}
+
+	address := args[0]
+
+	startHeight, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	endHeight, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, err := strconv.ParseInt(args[3], 10, 32)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	bookmark := args[4]
+
+	startKey, err := APIstub.CreateCompositeKey(txAddressIndexType, []string{address, formatHeight(startHeight)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//endHeight is inclusive, GetStateByRangeWithPagination's endKey is not
+	endKey, err := APIstub.CreateCompositeKey(txAddressIndexType, []string{address, formatHeight(endHeight + 1)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	iterator, metadata, err := APIstub.GetStateByRangeWithPagination(startKey, endKey, int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer iterator.Close()
+
+	store := s.store(APIstub)
+	records := []TransactionRecord{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, parts, err := APIstub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		height, _ := strconv.ParseUint(parts[1], 10, 64)
+		txid := parts[2]
+
+		transaction, err := store.GetTransaction(txid)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		records = append(records, TransactionRecord{
+			Txid:        txid,
+			Height:      height,
+			Timestamp:   height,
+			Transaction: transaction,
+		})
+	}
+
+	page := TransactionPage{Records: records, Bookmark: metadata.GetBookmark()}
+	pageAsBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(pageAsBytes)
+}
+
+// getBalance sums address's unspent native-coin outputs via the
+// address-indexed lookup instead of scanning every UTXO on the ledger.
+func (s *SmartContract) getBalance(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (address)")
+	}
+	return s.balanceResponse(APIstub, args[0], "")
+}
+
+// getBalanceByAsset sums address's unspent outputs of one colored coin.
+func (s *SmartContract) getBalanceByAsset(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 (address, symbol)")
+	}
+	return s.balanceResponse(APIstub, args[0], args[1])
+}
+
+func (s *SmartContract) balanceResponse(APIstub shim.ChaincodeStubInterface, address string, assetSymbol string) sc.Response {
+	utxos, err := s.store(APIstub).ListUTXOsByAddress(address)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var balance int64
+	for _, utxo := range utxos {
+		if checkUTXOOwnerShip(utxo, address) == false || utxo.AssetSymbol != assetSymbol {
+			continue
+		}
+		balance += amountOf(utxo)
+	}
+
+	return shim.Success([]byte(strconv.FormatInt(balance, 10)))
+}
+
+// rollback reverses every transaction indexed above height, most recent
+// first, restoring each one's spent inputs as unspent outputs, removing the
+// outputs it created, undoing its txidx~address~height~txid history entries,
+// and reversing any asset.Supply change it made (a mintToken or burnToken).
+// It's meant for the rare case where the peer detects the blocks above
+// height were orphaned by the ordering service.
+func (s *SmartContract) rollback(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (height)")
+	}
+
+	if err := requireAdmin(APIstub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	height, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	store := s.store(APIstub)
+
+	//PutTransaction indexes every transaction under the composite key type
+	//txIndexType (tx~timestamp~id), which is 0x00-prefixed, not a plain
+	//"tx~..." key - so it has to be read back the same way it was written.
+	iterator, err := APIstub.GetStateByPartialCompositeKey(txIndexType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	type indexedTx struct {
+		height uint64
+		txid   string
+		key    string
+	}
+	candidates := []indexedTx{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return shim.Error(err.Error())
+		}
+
+		_, parts, err := APIstub.SplitCompositeKey(item.Key)
+		if err != nil {
+			iterator.Close()
+			return shim.Error(err.Error())
+		}
+		h, _ := strconv.ParseUint(parts[0], 10, 64)
+		if h > height {
+			candidates = append(candidates, indexedTx{height: h, txid: parts[1], key: item.Key})
+		}
+	}
+	iterator.Close()
+
+	//walk the index in descending order so a transaction that later
+	//re-spent an orphaned output is always undone before that output's
+	//creating transaction is.
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].height > candidates[j].height })
+
+	reverted := 0
+	for _, c := range candidates {
+		transaction, err := store.GetTransaction(c.txid)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if transaction == nil {
+			continue
+		}
+
+		for _, output := range transaction.Outputs {
+			if err := store.DeleteUTXO(utxoPrimaryKey(output.Txid, output.Index)); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		for _, input := range transaction.Inputs {
+			//Coinbase/Mint inputs are synthetic (initState/mintToken), not a
+			//real prior UTXO, so there's nothing to restore.
+			if input.Address == "Coinbase" || input.Address == "Mint" {
+				continue
+			}
+			input.InOrOut = "out"
+			if err := store.PutUTXO(input); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		//undo the txidx~address~height~txid entries indexTransactionAddresses
+		//wrote for this transaction, at the same height they were written
+		//under (a transaction's height never changes), or
+		//queryTransactionsByAddress would keep returning this txid with a
+		//Transaction that's now null.
+		seenAddress := map[string]bool{}
+		for _, utxo := range append(append([]UTXO{}, transaction.Inputs...), transaction.Outputs...) {
+			address := utxo.Address
+			if address == "" || address == "Coinbase" || address == "Mint" || seenAddress[address] {
+				continue
+			}
+			seenAddress[address] = true
+
+			addressIndexKey, err := APIstub.CreateCompositeKey(txAddressIndexType, []string{address, formatHeight(c.height), c.txid})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if err := APIstub.DelState(addressIndexKey); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		//undo the supply change a reverted mintToken (Mint input) or
+		//burnToken (Burned output) made; initCurrency's own Coinbase input
+		//is its initial registration, not an adjustment, so it's left alone.
+		for _, input := range transaction.Inputs {
+			if input.Address == "Mint" && input.AssetSymbol != "" {
+				if err := adjustAssetSupply(APIstub, input.AssetSymbol, -amountOf(input)); err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
+		for _, output := range transaction.Outputs {
+			if output.Address == "Burned" && output.AssetSymbol != "" {
+				if err := adjustAssetSupply(APIstub, output.AssetSymbol, amountOf(output)); err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
+
+		if err := APIstub.DelState(c.txid); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := APIstub.DelState(c.key); err != nil {
+			return shim.Error(err.Error())
+		}
+		reverted++
+	}
+
+	if err := store.Flush(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(reverted)))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// reservationExpiryBlocks bounds how long a reservation can outlive the
+// transaction that created it before expireReservations may clear it.
+const reservationExpiryBlocks = 10
+
+// bnbSearchLimit caps how many branch-and-bound nodes ReserveFrom will
+// visit, so a wallet with many small UTXOs can't make a transfer
+// unboundedly slow.
+const bnbSearchLimit = 100000
+
+func reservationKey(txid string) string {
+	return "reservation~" + txid
+}
+
+func reservedMarkerKey(utxoKey string) string {
+	return "reserved~" + utxoKey
+}
+
+// Reservation records which UTXOs a pending signedTransfer call has claimed.
+// It stops a *later* transaction - one simulated after this one's writes
+// are visible - from selecting the same inputs. It does NOT protect against
+// another transaction already in flight in the same block: the shim only
+// exposes committed state to GetState, so two transactions endorsed
+// concurrently in the same block can't see each other's reservations
+// either way. What actually prevents a same-block double-spend is Fabric's
+// MVCC read-conflict check at commit time, which aborts whichever of the
+// two touched the same key second.
+type Reservation struct {
+	Txid         string   `json:"txid"`
+	Keys         []string `json:"keys"`
+	ExpiryHeight uint64   `json:"expiryHeight"`
+}
+
+// Reserver selects UTXOs to spend for a transfer and locks them against
+// concurrent selection, modeled after the reserve/cancel/expire lifecycle of
+// a UTXO wallet's in-memory coin keeper.
+type Reserver struct {
+	stub  shim.ChaincodeStubInterface
+	store WalletStore
+}
+
+// NewReserver builds a Reserver bound to the current transaction's store.
+func NewReserver(APIstub shim.ChaincodeStubInterface, store WalletStore) *Reserver {
+	return &Reserver{stub: APIstub, store: store}
+}
+
+// isReserved reports whether utxoKey is currently locked by another
+// transaction's reservation.
+func (r *Reserver) isReserved(utxoKey string) (bool, error) {
+	markerAsBytes, err := r.stub.GetState(reservedMarkerKey(utxoKey))
+	if err != nil {
+		return false, err
+	}
+	return markerAsBytes != nil, nil
+}
+
+// ReserveFrom selects unspent, unreserved UTXOs from candidates (a set the
+// caller already fetched and, for signedTransfer, signature-checked) that
+// cover amount, preferring (1) a single exact-match UTXO, then (2) a
+// branch-and-bound search that minimizes leftover change and input count,
+// then (3) a largest-first fallback so a transfer always succeeds if
+// candidates simply hold enough value. Selected UTXOs are locked under
+// reservation~<txid> until the caller spends (settleTransfer releases them)
+// or cancels them - this only blocks transactions simulated afterwards; see
+// the caveat on Reservation about same-block double-spends.
+//
+// The shim has no direct block-height accessor, so "height" is approximated
+// with the transaction timestamp (seconds since epoch); expireReservations
+// takes a value in the same unit.
+func (r *Reserver) ReserveFrom(candidates []UTXO, amount int64) ([]UTXO, int64, error) {
+
+	available := []UTXO{}
+	for _, utxo := range candidates {
+		reserved, err := r.isReserved(utxoPrimaryKey(utxo.Txid, utxo.Index))
+		if err != nil {
+			return nil, 0, err
+		}
+		if reserved {
+			continue
+		}
+		available = append(available, utxo)
+	}
+
+	selected, change, ok := exactMatch(available, amount)
+	if !ok {
+		selected, change, ok = branchAndBound(available, amount)
+	}
+	if !ok {
+		selected, change, ok = largestFirst(available, amount)
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("No enough amount to spend")
+	}
+
+	if err := r.commit(selected); err != nil {
+		return nil, 0, err
+	}
+
+	return selected, change, nil
+}
+
+func (r *Reserver) commit(selected []UTXO) error {
+	txid := r.stub.GetTxID()
+
+	timestamp, err := r.stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	expiryHeight := uint64(timestamp.GetSeconds()) + reservationExpiryBlocks
+
+	keys := make([]string, len(selected))
+	for i, utxo := range selected {
+		key := utxoPrimaryKey(utxo.Txid, utxo.Index)
+		keys[i] = key
+		if err := r.stub.PutState(reservedMarkerKey(key), []byte(txid)); err != nil {
+			return err
+		}
+	}
+
+	reservation := Reservation{Txid: txid, Keys: keys, ExpiryHeight: expiryHeight}
+	reservationAsBytes, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+	return r.stub.PutState(reservationKey(txid), reservationAsBytes)
+}
+
+// Release clears the reserved~ markers and the reservation~<txid> record
+// left by commit, for UTXOs that have now actually been spent. Without
+// this, settleTransfer would leave both behind as dead state for every
+// transfer, recoverable only via a later expireReservations call.
+func (r *Reserver) Release(selected []UTXO) error {
+	if len(selected) == 0 {
+		return nil
+	}
+
+	for _, utxo := range selected {
+		if err := r.stub.DelState(reservedMarkerKey(utxoPrimaryKey(utxo.Txid, utxo.Index))); err != nil {
+			return err
+		}
+	}
+
+	return r.stub.DelState(reservationKey(r.stub.GetTxID()))
+}
+
+// CancelReservation releases every UTXO held by txid's reservation without
+// spending them, e.g. after a transfer that ultimately failed to commit.
+func (r *Reserver) CancelReservation(txid string) error {
+	reservationAsBytes, err := r.stub.GetState(reservationKey(txid))
+	if err != nil {
+		return err
+	}
+	if reservationAsBytes == nil {
+		return fmt.Errorf("No reservation found for: %s", txid)
+	}
+
+	var reservation Reservation
+	if err := json.Unmarshal(reservationAsBytes, &reservation); err != nil {
+		return err
+	}
+
+	for _, key := range reservation.Keys {
+		if err := r.stub.DelState(reservedMarkerKey(key)); err != nil {
+			return err
+		}
+	}
+	return r.stub.DelState(reservationKey(txid))
+}
+
+// ExpireReservations releases every reservation whose ExpiryHeight is below
+// height, returning how many were cleared.
+func (r *Reserver) ExpireReservations(height uint64) (int, error) {
+	iterator, err := r.stub.GetStateByRange("reservation~", "reservation~\uffff")
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	expired := []string{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var reservation Reservation
+		if err := json.Unmarshal(item.Value, &reservation); err != nil {
+			return 0, err
+		}
+		if reservation.ExpiryHeight < height {
+			expired = append(expired, reservation.Txid)
+		}
+	}
+
+	for _, txid := range expired {
+		if err := r.CancelReservation(txid); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// amountOf parses utxo.Amount as an integer count of the asset's minor
+// units (e.g. cents), not a float: binary-float rounding is unsafe for
+// ledger balances.
+func amountOf(utxo UTXO) int64 {
+	amount, _ := strconv.ParseInt(utxo.Amount, 10, 64)
+	return amount
+}
+
+// exactMatch looks for a single UTXO whose amount equals target exactly, so
+// the transfer needs no change output at all.
+func exactMatch(available []UTXO, target int64) ([]UTXO, int64, bool) {
+	for _, utxo := range available {
+		if amountOf(utxo) == target {
+			return []UTXO{utxo}, 0, true
+		}
+	}
+	return nil, 0, false
+}
+
+// branchAndBound explores subsets of available (largest amount first) and
+// keeps the subset covering target with the smallest change and, as a
+// tiebreaker, the fewest inputs. It gives up after bnbSearchLimit nodes and
+// lets the caller fall back to largestFirst.
+func branchAndBound(available []UTXO, target int64) ([]UTXO, int64, bool) {
+	sorted := append([]UTXO{}, available...)
+	sort.Slice(sorted, func(i, j int) bool { return amountOf(sorted[i]) > amountOf(sorted[j]) })
+
+	var bestSelection []UTXO
+	var bestChange int64 = -1
+	visited := 0
+
+	var search func(start int, selection []UTXO, sum int64)
+	search = func(start int, selection []UTXO, sum int64) {
+		visited++
+		if visited > bnbSearchLimit {
+			return
+		}
+
+		if sum >= target {
+			change := sum - target
+			if bestChange < 0 || change < bestChange || (change == bestChange && len(selection) < len(bestSelection)) {
+				bestChange = change
+				bestSelection = append([]UTXO{}, selection...)
+			}
+			return
+		}
+		if start >= len(sorted) {
+			return
+		}
+
+		//include sorted[start] (copy first so sibling branches don't alias the same backing array)
+		with := append(append([]UTXO{}, selection...), sorted[start])
+		search(start+1, with, sum+amountOf(sorted[start]))
+		//exclude sorted[start]
+		search(start+1, selection, sum)
+	}
+
+	search(0, []UTXO{}, 0)
+
+	if bestSelection == nil {
+		return nil, 0, false
+	}
+	return bestSelection, bestChange, true
+}
+
+// largestFirst accumulates the biggest UTXOs until target is covered. It is
+// the same first-fit strategy the chaincode used before coin selection
+// existed, kept as a guaranteed-to-succeed fallback.
+func largestFirst(available []UTXO, target int64) ([]UTXO, int64, bool) {
+	sorted := append([]UTXO{}, available...)
+	sort.Slice(sorted, func(i, j int) bool { return amountOf(sorted[i]) > amountOf(sorted[j]) })
+
+	selection := []UTXO{}
+	var sum int64
+	for _, utxo := range sorted {
+		if sum >= target {
+			break
+		}
+		selection = append(selection, utxo)
+		sum += amountOf(utxo)
+	}
+	if sum < target {
+		return nil, 0, false
+	}
+	return selection, sum - target, true
+}
+
+// cancelReservation releases the UTXOs held by a reservation that will
+// never be spent, e.g. one built by a client that abandoned the transfer.
+func (s *SmartContract) cancelReservation(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (txid)")
+	}
+
+	if err := NewReserver(APIstub, s.store(APIstub)).CancelReservation(args[0]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// expireReservations clears every reservation whose expiry height is below
+// height, freeing its UTXOs back up for selection.
+func (s *SmartContract) expireReservations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (height)")
+	}
+
+	height, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cleared, err := NewReserver(APIstub, s.store(APIstub)).ExpireReservations(height)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(cleared)))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func utxoWithAmount(amount int64) UTXO {
+	return makeUTXO("tx", "0", strconv.FormatInt(amount, 10), "addr", "out")
+}
+
+func TestExactMatch(t *testing.T) {
+	candidates := []UTXO{utxoWithAmount(10), utxoWithAmount(25), utxoWithAmount(40)}
+
+	selected, change, ok := exactMatch(candidates, 25)
+	if !ok {
+		t.Fatalf("expected an exact match for 25")
+	}
+	if len(selected) != 1 || amountOf(selected[0]) != 25 {
+		t.Fatalf("expected the single 25 UTXO, got %+v", selected)
+	}
+	if change != 0 {
+		t.Fatalf("expected no change, got %d", change)
+	}
+
+	if _, _, ok := exactMatch(candidates, 30); ok {
+		t.Fatalf("expected no exact match for 30")
+	}
+}
+
+func TestBranchAndBoundMinimizesChange(t *testing.T) {
+	candidates := []UTXO{utxoWithAmount(5), utxoWithAmount(8), utxoWithAmount(20), utxoWithAmount(30)}
+
+	selected, change, ok := branchAndBound(candidates, 28)
+	if !ok {
+		t.Fatalf("expected branchAndBound to cover 28")
+	}
+
+	var sum int64
+	for _, utxo := range selected {
+		sum += amountOf(utxo)
+	}
+	if sum-28 != change {
+		t.Fatalf("change %d does not match selection sum %d - 28", change, sum)
+	}
+	// 8+20 covers exactly, and is strictly better than any other combination.
+	if change != 0 || len(selected) != 2 {
+		t.Fatalf("expected the 8+20 combination (0 change, 2 inputs), got %d change, %d inputs", change, len(selected))
+	}
+}
+
+func TestBranchAndBoundNoCover(t *testing.T) {
+	candidates := []UTXO{utxoWithAmount(5), utxoWithAmount(8)}
+
+	if _, _, ok := branchAndBound(candidates, 100); ok {
+		t.Fatalf("expected no selection to cover an amount larger than the total available")
+	}
+}
+
+func TestLargestFirstFallback(t *testing.T) {
+	candidates := []UTXO{utxoWithAmount(5), utxoWithAmount(8), utxoWithAmount(20)}
+
+	selected, change, ok := largestFirst(candidates, 22)
+	if !ok {
+		t.Fatalf("expected largestFirst to cover 22")
+	}
+	// largest-first takes 20, then 8 to reach 28, leaving change 6.
+	if len(selected) != 2 || change != 6 {
+		t.Fatalf("expected 2 inputs with change 6, got %d inputs with change %d", len(selected), change)
+	}
+}
+
+func TestLargestFirstInsufficientFunds(t *testing.T) {
+	candidates := []UTXO{utxoWithAmount(5), utxoWithAmount(8)}
+
+	if _, _, ok := largestFirst(candidates, 100); ok {
+		t.Fatalf("expected largestFirst to fail when candidates can't cover the target")
+	}
+}
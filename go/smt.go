@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// utxoRootKey stores the current root of the sparse Merkle tree maintained
+// over the UTXO set.
+const utxoRootKey = "utxo_root"
+
+// smtDepth is the tree's depth: one level per bit of a sha256 leaf path, so
+// every possible "txid:index" hashes to its own leaf slot without collision.
+const smtDepth = 256
+
+// smtNodeKey is where an internal node's (left, right) child hashes are
+// persisted, addressed by the node's own hash rather than by its position in
+// the tree (a content-addressed hash trie).
+func smtNodeKey(hash []byte) string {
+	return "smt~" + hex.EncodeToString(hash)
+}
+
+// smtNodeData is the on-chain (and in-memory, see merkleBatch) representation
+// of one internal node.
+type smtNodeData struct {
+	Left  string `json:"left"`
+	Right string `json:"right"`
+}
+
+// smtDefaultHashes[h] is the hash of an empty subtree of height h (h=0 is an
+// absent leaf). Precomputing these means an empty branch never has to be
+// written to state: putNode/getNode recognize a default hash and synthesize
+// its children instead of reading/writing smt~<hash>.
+var smtDefaultHashes = computeSMTDefaultHashes()
+
+func computeSMTDefaultHashes() [][]byte {
+	hashes := make([][]byte, smtDepth+1)
+
+	emptyLeaf := sha256.Sum256([]byte{})
+	hashes[0] = emptyLeaf[:]
+
+	for h := 1; h <= smtDepth; h++ {
+		sum := sha256.Sum256(append(append([]byte{}, hashes[h-1]...), hashes[h-1]...))
+		hashes[h] = sum[:]
+	}
+	return hashes
+}
+
+// bitAt returns the bit of hash at pos (0 = most significant bit of byte 0).
+func bitAt(hash []byte, pos int) int {
+	return int((hash[pos/8] >> uint(7-pos%8)) & 1)
+}
+
+// merkleBatch accumulates every leaf/node/root change made against the
+// sparse Merkle tree during a single invocation, and only writes them to
+// state once, via Flush. This exists because the shim does not expose a
+// transaction's own pending PutState calls to later GetState calls in the
+// same invocation: without it, spending several UTXOs in one transfer would
+// have each leaf update recompute from the same stale on-chain root and the
+// last one would clobber the rest.
+type merkleBatch struct {
+	root   []byte
+	loaded bool
+	nodes  map[string]smtNodeData // hex(hash) -> node, not yet flushed to state
+}
+
+func newMerkleBatch() *merkleBatch {
+	return &merkleBatch{nodes: map[string]smtNodeData{}}
+}
+
+func (b *merkleBatch) loadRoot(APIstub shim.ChaincodeStubInterface) ([]byte, error) {
+	if b.loaded {
+		return b.root, nil
+	}
+
+	rootAsBytes, err := APIstub.GetState(utxoRootKey)
+	if err != nil {
+		return nil, err
+	}
+	if rootAsBytes == nil {
+		b.root = smtDefaultHashes[smtDepth]
+	} else {
+		b.root = rootAsBytes
+	}
+	b.loaded = true
+	return b.root, nil
+}
+
+// getNode returns the (left, right) children of hash at height, preferring a
+// pending in-batch node over whatever is (or isn't yet) in state.
+func (b *merkleBatch) getNode(APIstub shim.ChaincodeStubInterface, hash []byte, height int) ([]byte, []byte, error) {
+	if bytes.Equal(hash, smtDefaultHashes[height]) {
+		child := smtDefaultHashes[height-1]
+		return child, child, nil
+	}
+
+	hashHex := hex.EncodeToString(hash)
+	if node, ok := b.nodes[hashHex]; ok {
+		left, err := hex.DecodeString(node.Left)
+		if err != nil {
+			return nil, nil, err
+		}
+		right, err := hex.DecodeString(node.Right)
+		if err != nil {
+			return nil, nil, err
+		}
+		return left, right, nil
+	}
+
+	raw, err := APIstub.GetState(smtNodeKey(hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	if raw == nil {
+		return nil, nil, fmt.Errorf("missing merkle node %s at height %d", hashHex, height)
+	}
+
+	var node smtNodeData
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return nil, nil, err
+	}
+	left, err := hex.DecodeString(node.Left)
+	if err != nil {
+		return nil, nil, err
+	}
+	right, err := hex.DecodeString(node.Right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return left, right, nil
+}
+
+// putNode hashes (left, right) into a node covering height and records it in
+// the batch, unless that hash is the known default for height, in which
+// case there is nothing new to remember.
+func (b *merkleBatch) putNode(left []byte, right []byte, height int) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, left...), right...))
+	hash := sum[:]
+
+	if bytes.Equal(hash, smtDefaultHashes[height]) {
+		return hash
+	}
+
+	b.nodes[hex.EncodeToString(hash)] = smtNodeData{Left: hex.EncodeToString(left), Right: hex.EncodeToString(right)}
+	return hash
+}
+
+// smtStep is one level of the path between a leaf and the root: the sibling
+// hash at that level and which side it sits on.
+type smtStep struct {
+	height   int
+	bitIsOne bool
+	sibling  []byte
+}
+
+// path descends from the batch's current root to leafPath's leaf, returning
+// the leaf's current hash and its sibling path ordered leaf-to-root (the
+// order both updateLeaf and getUTXOProof need to recombine hashes upward).
+func (b *merkleBatch) path(APIstub shim.ChaincodeStubInterface, leafPath []byte) ([]byte, []smtStep, error) {
+	root, err := b.loadRoot(APIstub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cur := root
+	rootToLeaf := make([]smtStep, 0, smtDepth)
+	for h := smtDepth; h >= 1; h-- {
+		left, right, err := b.getNode(APIstub, cur, h)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		bit := bitAt(leafPath, smtDepth-h)
+		var sibling []byte
+		if bit == 0 {
+			sibling, cur = right, left
+		} else {
+			sibling, cur = left, right
+		}
+		rootToLeaf = append(rootToLeaf, smtStep{height: h, bitIsOne: bit == 1, sibling: sibling})
+	}
+
+	leafToRoot := make([]smtStep, len(rootToLeaf))
+	for i, step := range rootToLeaf {
+		leafToRoot[len(rootToLeaf)-1-i] = step
+	}
+	return cur, leafToRoot, nil
+}
+
+// updateLeaf sets the leaf at leafPath to newLeafHash and recomputes every
+// node on the path up to the root, all in memory - nothing reaches state
+// until Flush is called.
+func (b *merkleBatch) updateLeaf(APIstub shim.ChaincodeStubInterface, leafPath []byte, newLeafHash []byte) error {
+	_, steps, err := b.path(APIstub, leafPath)
+	if err != nil {
+		return err
+	}
+
+	current := newLeafHash
+	for _, step := range steps {
+		var left, right []byte
+		if step.bitIsOne {
+			left, right = step.sibling, current
+		} else {
+			left, right = current, step.sibling
+		}
+		current = b.putNode(left, right, step.height)
+	}
+
+	b.root = current
+	b.loaded = true
+	return nil
+}
+
+// flush persists every node accumulated so far plus the final root. It's
+// safe to call more than once (e.g. at the end of every handler that
+// touches the store): already-flushed nodes are simply rewritten.
+func (b *merkleBatch) flush(APIstub shim.ChaincodeStubInterface) error {
+	for hashHex, node := range b.nodes {
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+		if err := APIstub.PutState(smtNodeKey(hash), data); err != nil {
+			return err
+		}
+	}
+
+	if b.loaded {
+		if err := APIstub.PutState(utxoRootKey, b.root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateUTXOLeaf keeps b in sync with the UTXO set: utxo is the record now
+// stored under primaryKey, or nil if it was just deleted. ShimStore/
+// CouchStore call this from PutUTXO/DeleteUTXO so every code path that
+// mutates a UTXO - transfers, mint/burn, rollback - updates the same batch,
+// which its caller flushes once at the end of the invocation.
+func updateUTXOLeaf(APIstub shim.ChaincodeStubInterface, b *merkleBatch, primaryKey string, utxo *UTXO) error {
+	leafPath := sha256.Sum256([]byte(primaryKey))
+
+	var leafHash []byte
+	if utxo == nil {
+		leafHash = smtDefaultHashes[0]
+	} else {
+		utxoAsBytes, err := json.Marshal(*utxo)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(utxoAsBytes)
+		leafHash = sum[:]
+	}
+
+	return b.updateLeaf(APIstub, leafPath[:], leafHash)
+}
+
+// MerkleProofStep is one sibling on the path from a UTXO's leaf to the root.
+type MerkleProofStep struct {
+	Hash          string `json:"hash"`
+	SiblingOnLeft bool   `json:"siblingOnLeft"`
+}
+
+// MerkleProof lets an off-chain light client verify a UTXO's inclusion
+// against a root it already trusts, without downloading the UTXO set.
+type MerkleProof struct {
+	UTXOKey  string            `json:"utxoKey"`
+	LeafHash string            `json:"leafHash"`
+	Path     []MerkleProofStep `json:"path"`
+	Root     string            `json:"root"`
+}
+
+// getUTXOProof returns utxoKey's inclusion proof: its leaf hash, the sibling
+// path up to the root (ordered leaf-to-root), and the current root. It only
+// reads the tree, so a fresh, empty batch is enough to walk the committed
+// state.
+func (s *SmartContract) getUTXOProof(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 (utxo key, txid:index)")
+	}
+	utxoKey := args[0]
+
+	batch := newMerkleBatch()
+
+	leafPath := sha256.Sum256([]byte(utxoKey))
+	leafHash, steps, err := batch.path(APIstub, leafPath[:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	root, err := batch.loadRoot(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	path := make([]MerkleProofStep, len(steps))
+	for i, step := range steps {
+		path[i] = MerkleProofStep{Hash: hex.EncodeToString(step.sibling), SiblingOnLeft: step.bitIsOne}
+	}
+
+	proof := MerkleProof{
+		UTXOKey:  utxoKey,
+		LeafHash: hex.EncodeToString(leafHash),
+		Path:     path,
+		Root:     hex.EncodeToString(root),
+	}
+
+	proofAsBytes, err := json.Marshal(proof)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(proofAsBytes)
+}
+
+// RootResponse is the result of getUTXORoot.
+type RootResponse struct {
+	Root   string `json:"root"`
+	Height uint64 `json:"height"`
+}
+
+// getUTXORoot returns the UTXO set's current Merkle root and the current
+// height (see txHeight) of this invocation.
+func (s *SmartContract) getUTXORoot(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	root, err := newMerkleBatch().loadRoot(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	height, err := txHeight(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	response := RootResponse{Root: hex.EncodeToString(root), Height: height}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(responseAsBytes)
+}
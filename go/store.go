@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Composite key object types used to index UTXOs and transactions so that
+// lookups by address or time no longer require a full GetStateByRange scan.
+const (
+	utxoIndexType = "utxo~address~txid~index"
+	txIndexType   = "tx~timestamp~id"
+)
+
+// WalletStore hides the raw APIstub Put/Get/Del calls behind a small
+// repository interface so the chaincode logic can be unit tested against a
+// mock and so the on-chain representation (composite keys, rich query docs)
+// can evolve independently of the transfer/query handlers.
+type WalletStore interface {
+	GetUTXO(key string) (*UTXO, error)
+	PutUTXO(utxo UTXO) error
+	DeleteUTXO(key string) error
+	ListUTXOsByAddress(addr string) ([]UTXO, error)
+	GetTransaction(id string) (*Transaction, error)
+	PutTransaction(tx Transaction) error
+	IterateUTXOs(prefix string) ([]UTXO, error)
+
+	// Flush persists every pending Merkle tree change accumulated by
+	// PutUTXO/DeleteUTXO calls made against this store so far. Every caller
+	// that mutates a UTXO through the store (a transfer, a mint, a rollback)
+	// must call it after its last mutation - otherwise the tree update from
+	// PutUTXO/DeleteUTXO is invisible. Calling it more than once is harmless.
+	Flush() error
+}
+
+// ShimStore is the default WalletStore backed directly by the Fabric shim
+// APIstub. It keeps the original "txid:index" key as the primary record and
+// maintains a secondary utxo~address~txid~index composite key so UTXOs can
+// be looked up per address without scanning the whole ledger.
+//
+// merkle accumulates this invocation's sparse-Merkle-tree updates in memory
+// (see smt.go): the shim has no read-your-writes visibility within a single
+// invocation, so recomputing the tree from state after every PutUTXO/
+// DeleteUTXO would only ever see the root as of the start of the
+// transaction. Flush writes the accumulated result once.
+type ShimStore struct {
+	stub   shim.ChaincodeStubInterface
+	merkle *merkleBatch
+}
+
+// NewShimStore wraps APIstub with the default WalletStore implementation.
+func NewShimStore(APIstub shim.ChaincodeStubInterface) *ShimStore {
+	return &ShimStore{stub: APIstub, merkle: newMerkleBatch()}
+}
+
+// Flush writes every Merkle tree node and the root accumulated so far.
+func (s *ShimStore) Flush() error {
+	return s.merkle.flush(s.stub)
+}
+
+func utxoPrimaryKey(txid string, index string) string {
+	return txid + ":" + index
+}
+
+func (s *ShimStore) utxoIndexKey(utxo UTXO) (string, error) {
+	return s.stub.CreateCompositeKey(utxoIndexType, []string{utxo.Address, utxo.Txid, utxo.Index})
+}
+
+func (s *ShimStore) GetUTXO(key string) (*UTXO, error) {
+	utxoAsBytes, err := s.stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if utxoAsBytes == nil {
+		return nil, nil
+	}
+
+	var utxo UTXO
+	if err := json.Unmarshal(utxoAsBytes, &utxo); err != nil {
+		return nil, err
+	}
+	return &utxo, nil
+}
+
+func (s *ShimStore) PutUTXO(utxo UTXO) error {
+	utxoAsBytes, err := json.Marshal(utxo)
+	if err != nil {
+		return err
+	}
+
+	if err := s.stub.PutState(utxoPrimaryKey(utxo.Txid, utxo.Index), utxoAsBytes); err != nil {
+		return err
+	}
+
+	indexKey, err := s.utxoIndexKey(utxo)
+	if err != nil {
+		return err
+	}
+	if err := s.stub.PutState(indexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	return updateUTXOLeaf(s.stub, s.merkle, utxoPrimaryKey(utxo.Txid, utxo.Index), &utxo)
+}
+
+func (s *ShimStore) DeleteUTXO(key string) error {
+	utxo, err := s.GetUTXO(key)
+	if err != nil {
+		return err
+	}
+	if utxo == nil {
+		return nil
+	}
+
+	if err := s.stub.DelState(key); err != nil {
+		return err
+	}
+
+	indexKey, err := s.utxoIndexKey(*utxo)
+	if err != nil {
+		return err
+	}
+	if err := s.stub.DelState(indexKey); err != nil {
+		return err
+	}
+
+	return updateUTXOLeaf(s.stub, s.merkle, key, nil)
+}
+
+// ListUTXOsByAddress uses GetStateByPartialCompositeKey so it only visits
+// the UTXOs owned by addr instead of every key on the ledger. It only
+// returns unspent outputs (InOrOut == "out"), matching CouchStore's Mango
+// selector so both backends return the same result set for the same
+// address.
+func (s *ShimStore) ListUTXOsByAddress(addr string) ([]UTXO, error) {
+	iterator, err := s.stub.GetStateByPartialCompositeKey(utxoIndexType, []string{addr})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	utxos := []UTXO{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, parts, err := s.stub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		utxo, err := s.GetUTXO(utxoPrimaryKey(parts[1], parts[2]))
+		if err != nil {
+			return nil, err
+		}
+		if utxo == nil || utxo.InOrOut != "out" {
+			continue
+		}
+		utxos = append(utxos, *utxo)
+	}
+	return utxos, nil
+}
+
+func (s *ShimStore) GetTransaction(id string) (*Transaction, error) {
+	txAsBytes, err := s.stub.GetState(id)
+	if err != nil {
+		return nil, err
+	}
+	if txAsBytes == nil {
+		return nil, nil
+	}
+
+	var tx Transaction
+	if err := json.Unmarshal(txAsBytes, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (s *ShimStore) PutTransaction(tx Transaction) error {
+	txAsBytes, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	if err := s.stub.PutState(tx.Id, txAsBytes); err != nil {
+		return err
+	}
+
+	timestamp, err := s.stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	indexKey, err := s.stub.CreateCompositeKey(txIndexType, []string{fmt.Sprintf("%020d", timestamp.GetSeconds()), tx.Id})
+	if err != nil {
+		return err
+	}
+	return s.stub.PutState(indexKey, []byte{0x00})
+}
+
+// IterateUTXOs returns every UTXO whose owning address exactly matches
+// prefix (GetStateByPartialCompositeKey matches the composite key's leading
+// attributes exactly, not a string prefix of the first one), or the full
+// UTXO set when prefix is empty. An empty, non-nil []string{prefix}
+// attribute would instead look for an address that is itself the empty
+// string, matching nothing - so the empty case needs its own, attribute-less
+// partial key.
+func (s *ShimStore) IterateUTXOs(prefix string) ([]UTXO, error) {
+	attrs := []string{}
+	if prefix != "" {
+		attrs = []string{prefix}
+	}
+
+	iterator, err := s.stub.GetStateByPartialCompositeKey(utxoIndexType, attrs)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	utxos := []UTXO{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, parts, err := s.stub.SplitCompositeKey(item.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		utxo, err := s.GetUTXO(utxoPrimaryKey(parts[1], parts[2]))
+		if err != nil {
+			return nil, err
+		}
+		if utxo == nil {
+			continue
+		}
+		utxos = append(utxos, *utxo)
+	}
+	return utxos, nil
+}
+
+// CouchStore is a WalletStore variant for deployments where the peer's state
+// database is CouchDB. It keeps ShimStore's composite-key indexing for
+// UTXOs and transactions, but also tags every UTXO document with a docType
+// field (transaction documents are stored untagged) so operators can register CouchDB indexes and run rich ad-hoc queries
+// (APIstub.GetQueryResult) against the state database directly.
+type CouchStore struct {
+	*ShimStore
+}
+
+// NewCouchStore wraps APIstub with the CouchDB-flavoured WalletStore.
+func NewCouchStore(APIstub shim.ChaincodeStubInterface) *CouchStore {
+	return &CouchStore{ShimStore: NewShimStore(APIstub)}
+}
+
+// couchUTXODoc tags a UTXO with a docType field so CouchDB indexes and
+// Mango selectors can distinguish UTXO documents from transaction documents
+// in the same database.
+type couchUTXODoc struct {
+	UTXO
+	DocType string `json:"docType"`
+}
+
+func (s *CouchStore) PutUTXO(utxo UTXO) error {
+	docAsBytes, err := json.Marshal(couchUTXODoc{UTXO: utxo, DocType: "utxo"})
+	if err != nil {
+		return err
+	}
+	if err := s.stub.PutState(utxoPrimaryKey(utxo.Txid, utxo.Index), docAsBytes); err != nil {
+		return err
+	}
+
+	indexKey, err := s.utxoIndexKey(utxo)
+	if err != nil {
+		return err
+	}
+	if err := s.stub.PutState(indexKey, []byte{0x00}); err != nil {
+		return err
+	}
+
+	return updateUTXOLeaf(s.stub, s.merkle, utxoPrimaryKey(utxo.Txid, utxo.Index), &utxo)
+}
+
+// ListUTXOsByAddress runs a Mango selector against CouchDB instead of the
+// composite-key range scan, so it can be combined with other rich-query
+// predicates (asset, amount range, ...) in later handlers.
+func (s *CouchStore) ListUTXOsByAddress(addr string) ([]UTXO, error) {
+	query := `{"selector":{"docType":"utxo","address":"` + addr + `","inOrOut":"out"}}`
+
+	iterator, err := s.stub.GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	utxos := []UTXO{}
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var utxo UTXO
+		if err := json.Unmarshal(item.Value, &utxo); err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, utxo)
+	}
+	return utxos, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func putTestUTXO(t *testing.T, store *ShimStore, address string, index string) {
+	t.Helper()
+	utxo := makeUTXO("tx1", index, "10", address, "out")
+	if err := store.PutUTXO(utxo); err != nil {
+		t.Fatalf("PutUTXO(%s) failed: %v", address, err)
+	}
+}
+
+func TestIterateUTXOsEmptyPrefixReturnsEverything(t *testing.T) {
+	stub := shim.NewMockStub("utxotest", nil)
+	stub.MockTransactionStart("tx1")
+	store := NewShimStore(stub)
+
+	putTestUTXO(t, store, "addrA", "0")
+	putTestUTXO(t, store, "addrB", "1")
+	stub.MockTransactionEnd("tx1")
+
+	utxos, err := store.IterateUTXOs("")
+	if err != nil {
+		t.Fatalf("IterateUTXOs(\"\") failed: %v", err)
+	}
+	if len(utxos) != 2 {
+		t.Fatalf("expected IterateUTXOs(\"\") to return every UTXO, got %d", len(utxos))
+	}
+}
+
+func TestIterateUTXOsPrefixFiltersByAddress(t *testing.T) {
+	stub := shim.NewMockStub("utxotest", nil)
+	stub.MockTransactionStart("tx1")
+	store := NewShimStore(stub)
+
+	putTestUTXO(t, store, "addrA", "0")
+	putTestUTXO(t, store, "addrB", "1")
+	stub.MockTransactionEnd("tx1")
+
+	utxos, err := store.IterateUTXOs("addrA")
+	if err != nil {
+		t.Fatalf("IterateUTXOs(addrA) failed: %v", err)
+	}
+	if len(utxos) != 1 || utxos[0].Address != "addrA" {
+		t.Fatalf("expected only addrA's UTXO, got %+v", utxos)
+	}
+}
+
+func TestListUTXOsByAddressExcludesSpent(t *testing.T) {
+	stub := shim.NewMockStub("utxotest", nil)
+	stub.MockTransactionStart("tx1")
+	store := NewShimStore(stub)
+
+	putTestUTXO(t, store, "addrA", "0")
+	spent := makeUTXO("tx1", "1", "10", "addrA", "in")
+	if err := store.PutUTXO(spent); err != nil {
+		t.Fatalf("PutUTXO(spent) failed: %v", err)
+	}
+	stub.MockTransactionEnd("tx1")
+
+	utxos, err := store.ListUTXOsByAddress("addrA")
+	if err != nil {
+		t.Fatalf("ListUTXOsByAddress failed: %v", err)
+	}
+	if len(utxos) != 1 || utxos[0].InOrOut != "out" {
+		t.Fatalf("expected only the unspent output, got %+v", utxos)
+	}
+}